@@ -0,0 +1,130 @@
+package build
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	blockservice "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	dag "github.com/ipfs/go-merkledag"
+	unixfile "github.com/ipfs/go-unixfs/io"
+	car "github.com/ipld/go-car"
+	"golang.org/x/xerrors"
+)
+
+// maxConcurrentCarFetches bounds how many CAR fetches run at once.
+// car.LoadCar reads a whole CAR into an in-memory blockstore before the
+// UnixFS reassembly in fetchCar can write a single byte to disk, so an
+// unbounded fan-out across multi-GB sector keys/params is a real OOM risk
+// on modest miner boxes; this caps the extra in-memory copies held at once
+// regardless of how many files GetParamsWithOptions fetches in parallel.
+const maxConcurrentCarFetches = 3
+
+var carFetchSem = make(chan struct{}, maxConcurrentCarFetches)
+
+// fetchCarToFile fetches and verifies a param file as a CAR from gw and
+// writes the reassembled file to out, truncating any previous content: a
+// half-written file from a failed CAR attempt must never be mistaken for a
+// complete one.
+func fetchCarToFile(ctx context.Context, gw string, out string, info paramFile, name string, progress ProgressReporter) error {
+	outf, err := os.OpenFile(out, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	return fetchCar(ctx, gw, info, outf, name, progress)
+}
+
+// fetchCar fetches a param file as a CAR from gw, verifying every block
+// against its CID as it streams in, and writes the reassembled UnixFS file
+// to out. Unlike a plain HTTP GET, the gateway serving the CAR is never
+// trusted: a corrupt or malicious block is caught before it ever reaches
+// disk.
+func fetchCar(ctx context.Context, gw string, info paramFile, out io.WriterAt, name string, progress ProgressReporter) error {
+	root, err := cid.Decode(info.Cid)
+	if err != nil {
+		return xerrors.Errorf("parsing cid %s: %w", info.Cid, err)
+	}
+
+	select {
+	case carFetchSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-carFetchSem }()
+
+	u := gw + info.Cid + "?format=car"
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return xerrors.Errorf("car fetch of %s from %s: unexpected status %s", info.Cid, gw, resp.Status)
+	}
+
+	progress.OnStart(name, resp.ContentLength)
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+
+	body := &progressReader{r: resp.Body, name: name, progress: progress}
+
+	ch, err := car.LoadCar(bstore, body)
+	if err != nil {
+		return xerrors.Errorf("loading car for %s from %s: %w", info.Cid, gw, err)
+	}
+
+	if len(ch.Roots) != 1 || !ch.Roots[0].Equals(root) {
+		return xerrors.Errorf("car from %s has unexpected root for %s", gw, info.Cid)
+	}
+
+	dagserv := dag.NewDAGService(blockservice.New(bstore, offline.Exchange(bstore)))
+
+	nd, err := dagserv.Get(ctx, root)
+	if err != nil {
+		return xerrors.Errorf("loading root node for %s: %w", info.Cid, err)
+	}
+
+	r, err := unixfile.NewDagReader(ctx, nd, dagserv)
+	if err != nil {
+		return xerrors.Errorf("opening unixfs reader for %s: %w", info.Cid, err)
+	}
+
+	if _, err := io.Copy(toWriter(out, 0), r); err != nil {
+		return xerrors.Errorf("writing %s: %w", info.Cid, err)
+	}
+
+	return nil
+}
+
+// offsetWriter adapts an io.WriterAt that is written to sequentially
+// starting at off into an io.Writer, so it can be used as the target of
+// io.Copy.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func toWriter(w io.WriterAt, off int64) io.Writer {
+	return &offsetWriter{w: w, off: off}
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
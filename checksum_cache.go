@@ -0,0 +1,153 @@
+package build
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/minio/blake2b-simd"
+)
+
+// paramCache is the on-disk sidecar for a param file's chunked digest, so a
+// re-check after a crash or restart doesn't have to re-hash segments whose
+// content hasn't changed. It lives next to the param file as
+// "<path>.paramcache".
+type paramCache struct {
+	Size           int64    `json:"size"`
+	ModTime        int64    `json:"mtime"`
+	SegmentDigests []string `json:"segment_digests"`
+	FinalDigest    string   `json:"final_digest"`
+}
+
+func cachePath(path string) string {
+	return path + ".paramcache"
+}
+
+func loadParamCache(path string) *paramCache {
+	b, err := ioutil.ReadFile(cachePath(path))
+	if err != nil {
+		return nil
+	}
+
+	var c paramCache
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil
+	}
+	return &c
+}
+
+func (c *paramCache) save(path string) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cachePath(path), b, 0666)
+}
+
+// chunkedDigest hashes f in info.SegmentSize segments, concurrently across a
+// GOMAXPROCS-sized worker pool, and returns the combined digest (the hash of
+// the concatenated segment digests, in order). When the file has grown since
+// the cache sidecar was written, every segment lying wholly inside the
+// sidecar's recorded size is reused instead of re-hashed, so a resumed
+// download only pays for the bytes that are actually new (plus the old
+// partial last segment, if any).
+func (ft *fetch) chunkedDigest(name, path string, f *os.File, size, mtime int64, info paramFile) (string, error) {
+	segSize := int64(info.SegmentSize)
+	numSegs := int((size + segSize - 1) / segSize)
+
+	cache := loadParamCache(path)
+	if cache != nil && cache.Size == size && cache.ModTime == mtime {
+		// Nothing has changed since the last check: the sidecar already
+		// has every segment digest, so there's nothing to hash at all.
+		ft.progress.OnVerify(name, size, size)
+		return cache.FinalDigest, nil
+	}
+
+	var reused []string
+	if cache != nil && cache.Size < size {
+		// The file only grew (a resumed download appending bytes), so the
+		// segments fully inside the old size are still good; only the new
+		// tail needs hashing.
+		reusable := int(cache.Size / segSize)
+		if reusable > len(cache.SegmentDigests) {
+			reusable = len(cache.SegmentDigests)
+		}
+		if reusable > numSegs {
+			reusable = numSegs
+		}
+		reused = cache.SegmentDigests[:reusable]
+	}
+
+	digests := make([]string, numSegs)
+	copy(digests, reused)
+
+	done := int64(len(reused)) * segSize
+	if done > size {
+		done = size
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var workErr error
+
+	workers := runtime.GOMAXPROCS(0)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				start := int64(idx) * segSize
+				end := start + segSize
+				if end > size {
+					end = size
+				}
+
+				buf := make([]byte, end-start)
+				if _, err := f.ReadAt(buf, start); err != nil {
+					mu.Lock()
+					if workErr == nil {
+						workErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+
+				h := blake2b.New512()
+				h.Write(buf)
+				d := hex.EncodeToString(h.Sum(nil)[:16])
+
+				mu.Lock()
+				digests[idx] = d
+				done += end - start
+				ft.progress.OnVerify(name, done, size)
+				mu.Unlock()
+			}
+		}()
+	}
+	for idx := len(reused); idx < numSegs; idx++ {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	if workErr != nil {
+		return "", workErr
+	}
+
+	fh := blake2b.New512()
+	for _, d := range digests {
+		fh.Write([]byte(d))
+	}
+	final := hex.EncodeToString(fh.Sum(nil)[:16])
+
+	newCache := &paramCache{Size: size, ModTime: mtime, SegmentDigests: digests, FinalDigest: final}
+	if err := newCache.save(path); err != nil {
+		log.Warnf("writing checksum cache for %s: %s", path, err)
+	}
+
+	return final, nil
+}
@@ -0,0 +1,109 @@
+package build
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, "param")
+	if err := os.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestChunkedDigestReusesCacheOnExactMatch(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 10)
+	path := writeTestFile(t, dir, content)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info := paramFile{SegmentSize: 4}
+	ft := &fetch{progress: NewJSONLinesProgress(io.Discard)}
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ft.chunkedDigest("param", path, f, stat.Size(), stat.ModTime().UnixNano(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := loadParamCache(path)
+	if cache == nil {
+		t.Fatal("expected a cache sidecar to be written")
+	}
+	if len(cache.SegmentDigests) != 3 {
+		t.Fatalf("10 bytes in 4-byte segments should be 3 segments, got %d", len(cache.SegmentDigests))
+	}
+
+	// Re-running against the unchanged file and cache must short-circuit
+	// to the cached final digest without re-hashing anything.
+	second, err := ft.chunkedDigest("param", path, f, stat.Size(), stat.ModTime().UnixNano(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Fatalf("chunkedDigest on unchanged file = %s, want %s (cached)", second, first)
+	}
+}
+
+func TestChunkedDigestReusesSegmentsAcrossResume(t *testing.T) {
+	dir := t.TempDir()
+
+	// First pass over a partial, 8-byte download: 2 full 4-byte segments.
+	partial := writeTestFile(t, dir, make([]byte, 8))
+	f, err := os.Open(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := paramFile{SegmentSize: 4}
+	ft := &fetch{progress: NewJSONLinesProgress(io.Discard)}
+
+	stat, _ := f.Stat()
+	if _, err := ft.chunkedDigest("param", partial, f, stat.Size(), stat.ModTime().UnixNano(), info); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cacheBefore := loadParamCache(partial)
+	if len(cacheBefore.SegmentDigests) != 2 {
+		t.Fatalf("expected 2 cached segments after the partial pass, got %d", len(cacheBefore.SegmentDigests))
+	}
+
+	// The download resumes and finishes at 10 bytes: the first two
+	// segments should be reused verbatim, with only the new tail hashed.
+	full := make([]byte, 10)
+	if err := os.WriteFile(partial, full, 0666); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Open(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	stat2, _ := f2.Stat()
+	if _, err := ft.chunkedDigest("param", partial, f2, stat2.Size(), stat2.ModTime().UnixNano(), info); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheAfter := loadParamCache(partial)
+	if len(cacheAfter.SegmentDigests) != 3 {
+		t.Fatalf("expected 3 segments after the resumed pass, got %d", len(cacheAfter.SegmentDigests))
+	}
+	if cacheAfter.SegmentDigests[0] != cacheBefore.SegmentDigests[0] || cacheAfter.SegmentDigests[1] != cacheBefore.SegmentDigests[1] {
+		t.Fatalf("expected the first 2 segment digests to be reused unchanged, got %v, want prefix %v", cacheAfter.SegmentDigests, cacheBefore.SegmentDigests)
+	}
+}
@@ -0,0 +1,175 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Fetcher is a pluggable source for a single param file's bytes. out is
+// always the destination file opened by the caller; implementations that
+// need file-level operations (seeking to resume, truncating before a
+// rewrite) recover it with a type assertion to *os.File.
+type Fetcher interface {
+	// Name identifies the fetcher in logs and in the error chain returned
+	// when every configured fetcher fails a given file.
+	Name() string
+	Fetch(ctx context.Context, name string, info paramFile, out io.WriterAt, progress ProgressReporter) error
+}
+
+// buildFetchers assembles the fetchers to try, in order, for this
+// GetParamsWithOptions call: a local IPFS node first when one is
+// configured (air-gapped miners and anyone already running Kubo would
+// rather not touch the public gateway at all), then the HTTP gateways,
+// then a user-supplied mirror manifest as a last resort.
+func buildFetchers(opts Options) []Fetcher {
+	var fetchers []Fetcher
+
+	if api := ipfsAPI(opts); api != "" {
+		fetchers = append(fetchers, &ipfsNodeFetcher{api: api})
+	}
+
+	fetchers = append(fetchers, &gatewayFetcher{gateways: gatewayList(opts)})
+
+	if manifest := mirrorManifest(opts); len(manifest) > 0 {
+		fetchers = append(fetchers, &mirrorFetcher{urls: manifest})
+	}
+
+	return fetchers
+}
+
+func ipfsAPI(opts Options) string {
+	if opts.IPFSAPI != "" {
+		return opts.IPFSAPI
+	}
+	return os.Getenv("IPFS_API")
+}
+
+func mirrorManifest(opts Options) map[string]string {
+	if len(opts.MirrorManifest) > 0 {
+		return opts.MirrorManifest
+	}
+
+	p := os.Getenv("PARAM_MIRROR_MANIFEST")
+	if p == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		log.Warnf("reading mirror manifest %s: %s", p, err)
+		return nil
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Warnf("parsing mirror manifest %s: %s", p, err)
+		return nil
+	}
+
+	return m
+}
+
+// truncate clears out so a fetcher that writes sequentially from offset 0
+// never leaves trailing bytes from a previous, longer, failed attempt.
+func truncate(out io.WriterAt) {
+	if f, ok := out.(*os.File); ok {
+		_ = f.Truncate(0)
+	}
+}
+
+// gatewayFetcher is the original HTTP-gateway fetcher: a trustless CAR
+// fetch across the configured gateways, falling back to plain (optionally
+// parallel-range) HTTP GETs.
+type gatewayFetcher struct {
+	gateways []string
+}
+
+func (f *gatewayFetcher) Name() string { return "gateway" }
+
+func (f *gatewayFetcher) Fetch(ctx context.Context, name string, info paramFile, out io.WriterAt, progress ProgressReporter) error {
+	outf, ok := out.(*os.File)
+	if !ok {
+		return xerrors.Errorf("gateway fetcher requires a file")
+	}
+
+	return doFetch(ctx, f.gateways, outf.Name(), info, name, progress)
+}
+
+// ipfsNodeFetcher fetches from a local Kubo/IPFS HTTP API rather than a
+// public gateway.
+type ipfsNodeFetcher struct {
+	api string // e.g. http://127.0.0.1:5001
+}
+
+func (f *ipfsNodeFetcher) Name() string { return "ipfs-api" }
+
+func (f *ipfsNodeFetcher) Fetch(ctx context.Context, name string, info paramFile, out io.WriterAt, progress ProgressReporter) error {
+	u := strings.TrimRight(f.api, "/") + "/api/v0/cat?arg=" + info.Cid
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return xerrors.Errorf("ipfs api %s returned %s", f.api, resp.Status)
+	}
+
+	truncate(out)
+	progress.OnStart(name, resp.ContentLength)
+
+	w := &progressWriter{w: toWriter(out, 0), name: name, progress: progress}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// mirrorFetcher resolves param file names to direct URLs via a
+// user-supplied manifest, for mirrors (e.g. an S3 bucket) that don't speak
+// IPFS at all.
+type mirrorFetcher struct {
+	urls map[string]string
+}
+
+func (f *mirrorFetcher) Name() string { return "mirror" }
+
+func (f *mirrorFetcher) Fetch(ctx context.Context, name string, info paramFile, out io.WriterAt, progress ProgressReporter) error {
+	u, ok := f.urls[name]
+	if !ok {
+		return xerrors.Errorf("no mirror entry for %s", name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return xerrors.Errorf("mirror %s returned %s", u, resp.Status)
+	}
+
+	truncate(out)
+	progress.OnStart(name, resp.ContentLength)
+
+	w := &progressWriter{w: toWriter(out, 0), name: name, progress: progress}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
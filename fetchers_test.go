@@ -0,0 +1,29 @@
+package build
+
+import "testing"
+
+func TestBuildFetchersOrder(t *testing.T) {
+	fetchers := buildFetchers(Options{
+		IPFSAPI:        "http://127.0.0.1:5001",
+		MirrorManifest: map[string]string{"v28-abc.params": "https://mirror.example.com/v28-abc.params"},
+	})
+
+	if len(fetchers) != 3 {
+		t.Fatalf("buildFetchers() = %d fetchers, want 3", len(fetchers))
+	}
+
+	want := []string{"ipfs-api", "gateway", "mirror"}
+	for i, name := range want {
+		if fetchers[i].Name() != name {
+			t.Errorf("fetchers[%d].Name() = %s, want %s", i, fetchers[i].Name(), name)
+		}
+	}
+}
+
+func TestBuildFetchersMinimal(t *testing.T) {
+	fetchers := buildFetchers(Options{})
+
+	if len(fetchers) != 1 || fetchers[0].Name() != "gateway" {
+		t.Fatalf("buildFetchers() with no IPFS API or mirror = %v, want just [gateway]", fetchers)
+	}
+}
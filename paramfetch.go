@@ -3,7 +3,6 @@ package build
 import (
 	"context"
 	"encoding/hex"
-	"encoding/json"
 	"io"
 	"net/http"
 	"net/url"
@@ -17,7 +16,6 @@ import (
 	"github.com/minio/blake2b-simd"
 	"go.uber.org/multierr"
 	"golang.org/x/xerrors"
-	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
 var log = logging.Logger("build")
@@ -34,15 +32,54 @@ type paramFile struct {
 	Cid        string `json:"cid"`
 	Digest     string `json:"digest"`
 	SectorSize uint64 `json:"sector_size"`
+
+	// Size is the file's declared byte size, used for the disk-space
+	// preflight and by GetParamsDryRun. Optional: when unset, the
+	// preflight falls back to probing it over HTTP instead.
+	Size uint64 `json:"size,omitempty"`
+
+	// SegmentSize and SegmentDigest opt a param file into chunked,
+	// cached verification: when SegmentSize is non-zero, checkFile hashes
+	// the file in that many bytes per segment, in parallel, and compares
+	// the combined digest against SegmentDigest instead of hashing the
+	// whole file against Digest. Manifests that don't set SegmentSize
+	// keep working exactly as before.
+	SegmentSize   uint64 `json:"segment_size,omitempty"`
+	SegmentDigest string `json:"segment_digest,omitempty"`
 }
 
 type fetch struct {
 	wg      sync.WaitGroup
 	fetchLk sync.Mutex
 
+	fetchers []Fetcher
+	progress ProgressReporter
+
 	errs []error
 }
 
+// Options configures optional behavior of GetParamsWithOptions.
+type Options struct {
+	// Gateways is an additional, programmatic set of gateways to fetch
+	// from, tried before the ones configured via IPFS_GATEWAY.
+	Gateways []string
+
+	// IPFSAPI is the base URL of a local Kubo/IPFS HTTP API, e.g.
+	// http://127.0.0.1:5001, tried before any gateway. Defaults to the
+	// IPFS_API env var.
+	IPFSAPI string
+
+	// MirrorManifest maps param file name to a direct download URL, for
+	// mirrors (e.g. an S3 bucket) that don't speak IPFS at all. Tried
+	// last, after the gateways. Defaults to the manifest at the
+	// PARAM_MIRROR_MANIFEST env var, if set.
+	MirrorManifest map[string]string
+
+	// Progress receives structured progress events in place of the
+	// default terminal progress bars. See ProgressReporter.
+	Progress ProgressReporter
+}
+
 func getParamDir() string {
 	if os.Getenv(dirEnv) == "" {
 		return paramdir
@@ -51,29 +88,48 @@ func getParamDir() string {
 }
 
 func GetParams(ctx context.Context, paramBytes []byte, storageSize uint64) error {
+	return GetParamsWithOptions(ctx, paramBytes, storageSize, Options{})
+}
+
+func GetParamsWithOptions(ctx context.Context, paramBytes []byte, storageSize uint64, opts Options) error {
 	if err := os.Mkdir(getParamDir(), 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
 
-	var params map[string]paramFile
+	params, err := parseParams(paramBytes)
+	if err != nil {
+		return err
+	}
+
+	params = wantedParams(params, storageSize)
 
-	if err := json.Unmarshal(paramBytes, &params); err != nil {
+	if err := preflightSpace(ctx, getParamDir(), params, opts); err != nil {
 		return err
 	}
 
-	ft := &fetch{}
+	ft := &fetch{fetchers: buildFetchers(opts), progress: defaultProgress(opts)}
 
 	for name, info := range params {
-		if storageSize != info.SectorSize && strings.HasSuffix(name, ".params") {
-			continue
-		}
-
 		ft.maybeFetchAsync(ctx, name, info)
 	}
 
 	return ft.wait(ctx)
 }
 
+// wantedParams filters a manifest down to the files GetParamsWithOptions
+// will actually fetch for storageSize: every non-.params file (keys, which
+// aren't sector-size specific), plus .params files matching storageSize.
+func wantedParams(params map[string]paramFile, storageSize uint64) map[string]paramFile {
+	out := make(map[string]paramFile, len(params))
+	for name, info := range params {
+		if storageSize != info.SectorSize && strings.HasSuffix(name, ".params") {
+			continue
+		}
+		out[name] = info
+	}
+	return out
+}
+
 func (ft *fetch) maybeFetchAsync(ctx context.Context, name string, info paramFile) {
 	ft.wg.Add(1)
 
@@ -82,33 +138,80 @@ func (ft *fetch) maybeFetchAsync(ctx context.Context, name string, info paramFil
 
 		path := filepath.Join(getParamDir(), name)
 
-		err := ft.checkFile(path, info)
+		err := ft.checkFile(name, path, info)
 		if !os.IsNotExist(err) && err != nil {
 			log.Warn(err)
 		}
 		if err == nil {
+			ft.progress.OnDone(name, nil)
 			return
 		}
 
 		ft.fetchLk.Lock()
 		defer ft.fetchLk.Unlock()
 
-		if err := doFetch(ctx, path, info); err != nil {
+		// Fetch into a .partial sibling and only rename it over the final
+		// name once it's verified, so a process killed mid-fetch never
+		// leaves a half-written file under the real name, where a later
+		// accidental TRUST_PARAMS=1 run would wrongly treat it as good.
+		partial := path + ".partial"
+
+		if err := ft.fetchFile(ctx, name, partial, info); err != nil {
 			ft.errs = append(ft.errs, xerrors.Errorf("fetching file %s failed: %w", path, err))
+			os.Remove(partial)
+			ft.progress.OnDone(name, err)
 			return
 		}
-		err = ft.checkFile(path, info)
+		err = ft.checkFile(name, partial, info)
 		if err != nil {
 			ft.errs = append(ft.errs, xerrors.Errorf("checking file %s failed: %w", path, err))
-			err := os.Remove(path)
-			if err != nil {
-				ft.errs = append(ft.errs, xerrors.Errorf("remove file %s failed: %w", path, err))
+			if rmErr := os.Remove(partial); rmErr != nil {
+				ft.errs = append(ft.errs, xerrors.Errorf("remove file %s failed: %w", partial, rmErr))
 			}
+			os.Remove(cachePath(partial))
+			ft.progress.OnDone(name, err)
+			return
+		}
+
+		if err = os.Rename(partial, path); err != nil {
+			ft.errs = append(ft.errs, xerrors.Errorf("renaming %s to %s failed: %w", partial, path, err))
+			ft.progress.OnDone(name, err)
+			return
 		}
+		os.Rename(cachePath(partial), cachePath(path))
+
+		checkedLk.Lock()
+		checked[path] = struct{}{}
+		checkedLk.Unlock()
+
+		ft.progress.OnDone(name, nil)
 	}()
 }
 
-func (ft *fetch) checkFile(path string, info paramFile) error {
+// fetchFile tries each configured fetcher in order, returning as soon as
+// one succeeds. If all of them fail, the returned error chains every
+// fetcher's individual failure so the caller can see exactly where a
+// given file came from and why it didn't land.
+func (ft *fetch) fetchFile(ctx context.Context, name, path string, info paramFile) error {
+	outf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	var errs []error
+	for _, f := range ft.fetchers {
+		if err := f.Fetch(ctx, name, info, outf, ft.progress); err != nil {
+			errs = append(errs, xerrors.Errorf("%s: %w", f.Name(), err))
+			continue
+		}
+		return nil
+	}
+
+	return xerrors.Errorf("all fetchers failed: %w", multierr.Combine(errs...))
+}
+
+func (ft *fetch) checkFile(name, path string, info paramFile) error {
 	if os.Getenv("TRUST_PARAMS") == "1" {
 		log.Warn("Assuming parameter files are ok. DO NOT USE IN PRODUCTION")
 		return nil
@@ -127,14 +230,34 @@ func (ft *fetch) checkFile(path string, info paramFile) error {
 	}
 	defer f.Close()
 
-	h := blake2b.New512()
-	if _, err := io.Copy(h, f); err != nil {
+	fStat, err := f.Stat()
+	if err != nil {
 		return err
 	}
 
-	sum := h.Sum(nil)
-	strSum := hex.EncodeToString(sum[:16])
-	if strSum == info.Digest {
+	ft.progress.OnVerify(name, 0, fStat.Size())
+
+	var strSum, expected string
+	if info.SegmentSize > 0 {
+		expected = info.SegmentDigest
+
+		strSum, err = ft.chunkedDigest(name, path, f, fStat.Size(), fStat.ModTime().UnixNano(), info)
+		if err != nil {
+			return err
+		}
+	} else {
+		expected = info.Digest
+
+		h := blake2b.New512()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		ft.progress.OnVerify(name, fStat.Size(), fStat.Size())
+
+		strSum = hex.EncodeToString(h.Sum(nil)[:16])
+	}
+
+	if strSum == expected {
 		log.Infof("Parameter file %s is ok", path)
 
 		checkedLk.Lock()
@@ -144,7 +267,7 @@ func (ft *fetch) checkFile(path string, info paramFile) error {
 		return nil
 	}
 
-	return xerrors.Errorf("checksum mismatch in param file %s, %s != %s", path, strSum, info.Digest)
+	return xerrors.Errorf("checksum mismatch in param file %s, %s != %s", path, strSum, expected)
 }
 
 func (ft *fetch) wait(ctx context.Context) error {
@@ -165,11 +288,83 @@ func (ft *fetch) wait(ctx context.Context) error {
 	return multierr.Combine(ft.errs...)
 }
 
-func doFetch(ctx context.Context, out string, info paramFile) error {
-	gw := os.Getenv("IPFS_GATEWAY")
-	if gw == "" {
-		gw = gateway
+// gatewayList returns the gateways to try, in order: opts.Gateways first,
+// then the comma-separated IPFS_GATEWAY env var, falling back to the
+// built-in default if neither is set. Duplicates are dropped. Every
+// gateway is normalized to end in a single trailing slash, so callers can
+// always concatenate it directly with a CID.
+func gatewayList(opts Options) []string {
+	var raw []string
+	raw = append(raw, opts.Gateways...)
+
+	if gw := os.Getenv("IPFS_GATEWAY"); gw != "" {
+		raw = append(raw, strings.Split(gw, ",")...)
+	}
+	if len(raw) == 0 {
+		raw = append(raw, gateway)
+	}
+
+	seen := map[string]struct{}{}
+	var out []string
+	for _, g := range raw {
+		if g = strings.TrimSpace(g); g == "" {
+			continue
+		}
+		g = strings.TrimRight(g, "/") + "/"
+		if _, ok := seen[g]; ok {
+			continue
+		}
+		seen[g] = struct{}{}
+		out = append(out, g)
+	}
+	return out
+}
+
+// doFetch fetches a param file, verifying it block-by-block as a CAR as it
+// streams in so that no single gateway needs to be trusted. If every
+// gateway fails the trustless path (old gateways not serving CARs, a
+// corrupt/truncated stream, etc.) it falls back to a plain HTTP fetch,
+// relying on the whole-file digest check in checkFile.
+func doFetch(ctx context.Context, gateways []string, out string, info paramFile, name string, progress ProgressReporter) error {
+	var lastErr error
+	for _, gw := range gateways {
+		log.Infof("Fetching %s from %s (trustless CAR)", out, gw)
+
+		if err := fetchCarToFile(ctx, gw, out, info, name, progress); err != nil {
+			log.Warnf("car fetch of %s from %s failed: %s", out, gw, err)
+			lastErr = err
+			continue
+		}
+
+		return nil
 	}
+
+	log.Warnf("trustless CAR fetch of %s failed on all gateways (%s), falling back to plain HTTP", out, lastErr)
+
+	return doFetchPlain(ctx, gateways, out, info, name, progress)
+}
+
+// doFetchPlain fetches a param file over plain HTTP. When at least two of
+// the configured gateways advertise byte-range support for the same
+// content length, the remaining bytes are split into chunks and fetched
+// from them in parallel, failing a chunk over to another gateway on
+// error; otherwise it falls back to the original single-gateway resumable
+// GET.
+func doFetchPlain(ctx context.Context, gateways []string, out string, info paramFile, name string, progress ProgressReporter) error {
+	if rgws, total := probeRangeGateways(ctx, gateways, info); len(rgws) > 1 {
+		log.Infof("Fetching %s using %d range-capable gateways in parallel", out, len(rgws))
+
+		if err := fetchRanges(ctx, rgws, out, total, name, progress); err != nil {
+			log.Warnf("parallel range fetch of %s failed, falling back to sequential GET: %s", out, err)
+		} else {
+			return nil
+		}
+	}
+
+	return fetchSequential(ctx, gateways[0], out, info, name, progress)
+}
+
+func fetchSequential(ctx context.Context, gw string, out string, info paramFile, name string, progress ProgressReporter) error {
 	log.Infof("Fetching %s from %s", out, gw)
 
 	outf, err := os.OpenFile(out, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -203,15 +398,11 @@ func doFetch(ctx context.Context, out string, info paramFile) error {
 	}
 	defer resp.Body.Close()
 
-	bar := pb.New64(fStat.Size() + resp.ContentLength)
-	bar.Set64(fStat.Size())
-	bar.Units = pb.U_BYTES
-	bar.ShowSpeed = true
-	bar.Start()
-
-	_, err = io.Copy(outf, bar.NewProxyReader(resp.Body))
+	progress.OnStart(name, fStat.Size()+resp.ContentLength)
+	progress.OnBytes(name, fStat.Size())
 
-	bar.Finish()
+	w := &progressWriter{w: outf, name: name, progress: progress}
+	_, err = io.Copy(w, resp.Body)
 
 	return err
 }
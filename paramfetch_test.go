@@ -0,0 +1,45 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGatewayListDedupAndNormalize(t *testing.T) {
+	t.Setenv("IPFS_GATEWAY", "https://a.example.com/ipfs,https://b.example.com/ipfs/")
+
+	got := gatewayList(Options{Gateways: []string{"https://a.example.com/ipfs/", " "}})
+
+	want := []string{"https://a.example.com/ipfs/", "https://b.example.com/ipfs/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("gatewayList() = %v, want %v", got, want)
+	}
+}
+
+func TestGatewayListDefault(t *testing.T) {
+	got := gatewayList(Options{})
+
+	if len(got) != 1 || got[0] != gateway {
+		t.Fatalf("gatewayList() with no config = %v, want [%s]", got, gateway)
+	}
+}
+
+func TestWantedParams(t *testing.T) {
+	params := map[string]paramFile{
+		"v28-abc.vk":           {},
+		"v28-abc.params":       {SectorSize: 1024},
+		"v28-abc-other.params": {SectorSize: 2048},
+	}
+
+	out := wantedParams(params, 1024)
+
+	if _, ok := out["v28-abc.vk"]; !ok {
+		t.Error("expected non-.params key file to always be included")
+	}
+	if _, ok := out["v28-abc.params"]; !ok {
+		t.Error("expected .params file matching storageSize to be included")
+	}
+	if _, ok := out["v28-abc-other.params"]; ok {
+		t.Error("expected .params file for a different sector size to be dropped")
+	}
+}
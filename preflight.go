@@ -0,0 +1,154 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// spaceMargin is how much headroom preflightSpace demands beyond the sum of
+// declared file sizes, to leave room for filesystem overhead and the
+// .partial files fetches are written to before being renamed into place.
+const spaceMargin = 1.05
+
+// ErrInsufficientSpace is returned by GetParamsWithOptions when the target
+// directory doesn't have enough free space for everything that needs to be
+// fetched.
+type ErrInsufficientSpace struct {
+	Dir    string
+	Needed uint64
+	Free   uint64
+}
+
+func (e *ErrInsufficientSpace) Error() string {
+	return fmt.Sprintf("insufficient space in %s: need %d bytes, have %d free", e.Dir, e.Needed, e.Free)
+}
+
+// PlannedFile describes one file GetParamsDryRun or preflightSpace would
+// fetch.
+type PlannedFile struct {
+	Name string
+	Size uint64
+}
+
+// FetchPlan is what GetParamsDryRun reports: everything GetParamsWithOptions
+// would fetch for the same arguments, and whether there's room for it,
+// without making a single network request.
+type FetchPlan struct {
+	Dir         string
+	Files       []PlannedFile
+	NeededBytes uint64
+	FreeBytes   uint64
+}
+
+// GetParamsDryRun reports the fetch plan for paramBytes/storageSize without
+// touching the network: which files are missing, how many bytes they add up
+// to, and how much free space the target directory has. Useful for sizing
+// storage before a first sealing.
+func GetParamsDryRun(paramBytes []byte, storageSize uint64, opts Options) (*FetchPlan, error) {
+	params, err := parseParams(paramBytes)
+	if err != nil {
+		return nil, err
+	}
+	params = wantedParams(params, storageSize)
+
+	dir := getParamDir()
+
+	plan := &FetchPlan{Dir: dir}
+
+	for name, info := range params {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		plan.Files = append(plan.Files, PlannedFile{Name: name, Size: info.Size})
+		plan.NeededBytes += info.Size
+	}
+
+	free, err := freeBytes(dir)
+	if err != nil {
+		return nil, err
+	}
+	plan.FreeBytes = free
+
+	return plan, nil
+}
+
+// preflightSpace sums the size of every file in params that isn't already
+// on disk and aborts with ErrInsufficientSpace if the target directory
+// doesn't have needed*spaceMargin bytes free. Files with no declared size
+// are probed with a HEAD request first.
+func preflightSpace(ctx context.Context, dir string, params map[string]paramFile, opts Options) error {
+	gateways := gatewayList(opts)
+
+	var needed uint64
+	for name, info := range params {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		size := info.Size
+		if size == 0 {
+			size = probeContentLength(ctx, gateways, info)
+		}
+		needed += size
+	}
+
+	free, err := freeBytes(dir)
+	if err != nil {
+		return err
+	}
+
+	if float64(free) < float64(needed)*spaceMargin {
+		return &ErrInsufficientSpace{Dir: dir, Needed: uint64(float64(needed) * spaceMargin), Free: free}
+	}
+
+	return nil
+}
+
+// probeContentLength HEADs gateways for info's CID and returns the first
+// Content-Length reported, or 0 if none of them answer usefully.
+func probeContentLength(ctx context.Context, gateways []string, info paramFile) uint64 {
+	for _, gw := range gateways {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", gw+info.Cid, nil)
+		if err != nil {
+			continue
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+			return uint64(resp.ContentLength)
+		}
+	}
+
+	return 0
+}
+
+// freeBytes returns the number of bytes free on the filesystem holding dir.
+func freeBytes(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+func parseParams(paramBytes []byte) (map[string]paramFile, error) {
+	var params map[string]paramFile
+	if err := json.Unmarshal(paramBytes, &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
@@ -0,0 +1,41 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreflightSpaceAppliesMargin(t *testing.T) {
+	dir := t.TempDir()
+
+	free, err := freeBytes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// needed*spaceMargin just over free must fail...
+	tooMuch := uint64(float64(free)/spaceMargin) + 1024*1024*1024
+	params := map[string]paramFile{"v28-abc.params": {Size: tooMuch}}
+
+	err = preflightSpace(context.Background(), dir, params, Options{})
+	var insufficient *ErrInsufficientSpace
+	if !errors.As(err, &insufficient) {
+		t.Fatalf("preflightSpace() with needed > free/margin = %v, want *ErrInsufficientSpace", err)
+	}
+	if insufficient.Needed != uint64(float64(tooMuch)*spaceMargin) {
+		t.Errorf("ErrInsufficientSpace.Needed = %d, want %d", insufficient.Needed, uint64(float64(tooMuch)*spaceMargin))
+	}
+
+	// ...and an already-fetched file isn't counted against the budget at all.
+	existing := filepath.Join(dir, "v28-abc.params")
+	if err := os.WriteFile(existing, []byte("x"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := preflightSpace(context.Background(), dir, params, Options{}); err != nil {
+		t.Fatalf("preflightSpace() with file already on disk = %v, want nil", err)
+	}
+}
+
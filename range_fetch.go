@@ -0,0 +1,205 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.uber.org/multierr"
+	"golang.org/x/xerrors"
+)
+
+// rangeChunks is how many pieces a fetch is split into across the
+// range-capable gateways found for it.
+const rangeChunks = 4
+
+// probeRangeGateways HEADs each gateway concurrently and returns the content
+// URLs (gateway + CID) of those that advertise byte-range support and agree
+// on a content length, along with that length. If the gateways disagree, the length reported by the
+// largest group of them wins.
+func probeRangeGateways(ctx context.Context, gateways []string, info paramFile) ([]string, int64) {
+	type probe struct {
+		url           string
+		contentLength int64
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []probe
+	)
+
+	for _, gw := range gateways {
+		wg.Add(1)
+		go func(gw string) {
+			defer wg.Done()
+
+			u := gw + info.Cid
+
+			req, err := http.NewRequestWithContext(ctx, "HEAD", u, nil)
+			if err != nil {
+				return
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+				return
+			}
+
+			mu.Lock()
+			results = append(results, probe{url: u, contentLength: resp.ContentLength})
+			mu.Unlock()
+		}(gw)
+	}
+	wg.Wait()
+
+	counts := map[int64]int{}
+	for _, p := range results {
+		counts[p.contentLength]++
+	}
+
+	var agreedLen int64
+	for l, n := range counts {
+		if n > counts[agreedLen] {
+			agreedLen = l
+		}
+	}
+
+	var urls []string
+	for _, p := range results {
+		if p.contentLength == agreedLen {
+			urls = append(urls, p.url)
+		}
+	}
+
+	return urls, agreedLen
+}
+
+type rangeSpan struct {
+	start, end int64 // inclusive
+}
+
+// fetchRanges downloads total bytes of out by splitting the remaining,
+// not-yet-fetched bytes into chunks and dispatching them concurrently
+// across gateways, writing each directly to its offset with WriteAt. A
+// chunk fails over to the next gateway in the list before the whole fetch
+// is considered failed. Bytes already on disk from a prior interrupted
+// attempt are left alone and not re-fetched.
+func fetchRanges(ctx context.Context, gateways []string, out string, total int64, name string, progress ProgressReporter) error {
+	outf, err := os.OpenFile(out, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	fStat, err := outf.Stat()
+	if err != nil {
+		return err
+	}
+	existing := fStat.Size()
+
+	progress.OnStart(name, total)
+	progress.OnBytes(name, existing)
+
+	if existing >= total {
+		return nil
+	}
+
+	n := rangeChunks
+	if n > len(gateways) {
+		n = len(gateways)
+	}
+
+	spans := splitSpans(total-existing, n)
+	for i := range spans {
+		spans[i].start += existing
+		spans[i].end += existing
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for i, span := range spans {
+		wg.Add(1)
+		go func(i int, span rangeSpan) {
+			defer wg.Done()
+
+			// Start each chunk on a different gateway so the N chunks are
+			// spread across the N gateways instead of piling onto the first.
+			order := append(append([]string{}, gateways[i%len(gateways):]...), gateways[:i%len(gateways)]...)
+
+			var lastErr error
+			for _, gw := range order {
+				if err := fetchRangeSpan(ctx, gw, outf, span, name, progress); err != nil {
+					lastErr = err
+					continue
+				}
+				return
+			}
+
+			mu.Lock()
+			errs = append(errs, xerrors.Errorf("range %d-%d failed on all gateways: %w", span.start, span.end, lastErr))
+			mu.Unlock()
+		}(i, span)
+	}
+	wg.Wait()
+
+	return multierr.Combine(errs...)
+}
+
+// splitSpans divides [0, total) into n roughly equal inclusive byte ranges.
+func splitSpans(total int64, n int) []rangeSpan {
+	if n < 1 {
+		n = 1
+	}
+
+	size := total / int64(n)
+	if size < 1 {
+		size = total
+		n = 1
+	}
+
+	spans := make([]rangeSpan, 0, n)
+	for i := 0; i < n; i++ {
+		start := int64(i) * size
+		end := start + size - 1
+		if i == n-1 {
+			end = total - 1
+		}
+		spans = append(spans, rangeSpan{start: start, end: end})
+	}
+	return spans
+}
+
+func fetchRangeSpan(ctx context.Context, u string, outf *os.File, span rangeSpan, name string, progress ProgressReporter) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", span.start, span.end))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return xerrors.Errorf("gateway %s did not honor range request: %s", u, resp.Status)
+	}
+
+	w := &progressWriter{w: toWriter(outf, span.start), name: name, progress: progress}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
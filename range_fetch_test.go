@@ -0,0 +1,73 @@
+package build
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplitSpans(t *testing.T) {
+	cases := []struct {
+		total int64
+		n     int
+		want  []rangeSpan
+	}{
+		{total: 100, n: 4, want: []rangeSpan{{0, 24}, {25, 49}, {50, 74}, {75, 99}}},
+		{total: 10, n: 3, want: []rangeSpan{{0, 2}, {3, 5}, {6, 9}}},
+		{total: 2, n: 4, want: []rangeSpan{{0, 1}}},
+		{total: 5, n: 0, want: []rangeSpan{{0, 4}}},
+	}
+
+	for _, c := range cases {
+		got := splitSpans(c.total, c.n)
+		if len(got) != len(c.want) {
+			t.Fatalf("splitSpans(%d, %d) = %v, want %v", c.total, c.n, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("splitSpans(%d, %d)[%d] = %v, want %v", c.total, c.n, i, got[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestProbeRangeGatewaysMajorityVote(t *testing.T) {
+	agree1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer agree1.Close()
+
+	agree2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer agree2.Close()
+
+	stale := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "999")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer stale.Close()
+
+	noRange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer noRange.Close()
+
+	gateways := []string{agree1.URL + "/", agree2.URL + "/", stale.URL + "/", noRange.URL + "/"}
+
+	urls, total := probeRangeGateways(context.Background(), gateways, paramFile{Cid: "bafy"})
+
+	if total != 1000 {
+		t.Fatalf("expected agreed length 1000, got %d", total)
+	}
+	if len(urls) != 2 {
+		t.Fatalf("expected the 2 agreeing gateways to win, got %v", urls)
+	}
+}